@@ -0,0 +1,152 @@
+package main
+
+import (
+	"sort"
+
+	pb "magica/mcp/proto/magica_daw"
+)
+
+// layerVelocityThreshold is how far apart two otherwise-coincident notes'
+// velocities must be before they're treated as deliberately layered notes
+// rather than near-duplicates from a double-triggered controller.
+const layerVelocityThreshold = 20
+
+// dedupeNotes replaces exact pitch+start-time-key matching with a
+// clustering pass: notes are grouped by pitch, sorted by start time, and
+// notes starting within opts.EpsilonMs of their cluster's first note are
+// merged into a single note (velocity per opts.MergeStrategy, duration
+// spanning the union). A second pass then finds flams -- same-pitch notes separated by
+// opts.FlamMinMs..opts.FlamMaxMs -- and drops the later one unless
+// opts.KeepFlams is set.
+func dedupeNotes(notes []*pb.MidiNote, opts *pb.DedupeOptions) []*pb.MidiNote {
+	epsilon := opts.EpsilonMs / 1000
+	flamMin := opts.FlamMinMs / 1000
+	flamMax := opts.FlamMaxMs / 1000
+
+	byPitch := make(map[int32][]*pb.MidiNote)
+	for _, note := range notes {
+		byPitch[note.Pitch] = append(byPitch[note.Pitch], note)
+	}
+
+	pitches := make([]int32, 0, len(byPitch))
+	for pitch := range byPitch {
+		pitches = append(pitches, pitch)
+	}
+	sort.Slice(pitches, func(i, j int) bool { return pitches[i] < pitches[j] })
+
+	var result []*pb.MidiNote
+	for _, pitch := range pitches {
+		group := byPitch[pitch]
+		sort.Slice(group, func(i, j int) bool { return group[i].StartTime < group[j].StartTime })
+
+		merged := mergeNearDuplicates(group, epsilon, opts.MergeStrategy)
+		merged = removeFlams(merged, flamMin, flamMax, opts.KeepFlams)
+		result = append(result, merged...)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].StartTime != result[j].StartTime {
+			return result[i].StartTime < result[j].StartTime
+		}
+		return result[i].Pitch < result[j].Pitch
+	})
+
+	return result
+}
+
+// mergeNearDuplicates merges same-pitch notes whose start times fall
+// within epsilon of each other, unless their velocities differ enough to
+// indicate a deliberately layered note. Membership is judged against the
+// cluster's first note, not its most recently added one, so a chain of
+// notes each close to its neighbor but far from the start (a legato run
+// or crescendo) doesn't collapse into a single note.
+func mergeNearDuplicates(group []*pb.MidiNote, epsilon float64, mergeStrategy string) []*pb.MidiNote {
+	if len(group) == 0 {
+		return nil
+	}
+
+	var clusters [][]*pb.MidiNote
+	for _, note := range group {
+		if len(clusters) > 0 {
+			cluster := clusters[len(clusters)-1]
+			first := cluster[0]
+			if note.StartTime-first.StartTime <= epsilon && abs32(note.Velocity-first.Velocity) <= layerVelocityThreshold {
+				clusters[len(clusters)-1] = append(cluster, note)
+				continue
+			}
+		}
+		clusters = append(clusters, []*pb.MidiNote{note})
+	}
+
+	merged := make([]*pb.MidiNote, 0, len(clusters))
+	for _, cluster := range clusters {
+		merged = append(merged, mergeCluster(cluster, mergeStrategy))
+	}
+	return merged
+}
+
+func mergeCluster(cluster []*pb.MidiNote, mergeStrategy string) *pb.MidiNote {
+	if len(cluster) == 1 {
+		return cluster[0]
+	}
+
+	merged := *cluster[0]
+
+	end := merged.StartTime + merged.Duration
+	var velocitySum int32
+	for _, note := range cluster {
+		if noteEnd := note.StartTime + note.Duration; noteEnd > end {
+			end = noteEnd
+		}
+		if note.StartTime < merged.StartTime {
+			merged.StartTime = note.StartTime
+		}
+		if mergeStrategy == "max" && note.Velocity > merged.Velocity {
+			merged.Velocity = note.Velocity
+		}
+		velocitySum += note.Velocity
+	}
+	if mergeStrategy == "mean" {
+		merged.Velocity = velocitySum / int32(len(cluster))
+	}
+	merged.Duration = end - merged.StartTime
+
+	return &merged
+}
+
+// removeFlams drops the later note of any same-pitch pair whose gap falls
+// within [flamMin, flamMax], unless keepFlams is set. A flam is an
+// isolated grace-note/main-note pair, so once a pair is consumed the next
+// candidate is compared against the note *after* it, not the one just
+// dropped -- otherwise a run of evenly-spaced repeated notes (e.g. a
+// 16th-note drum roll) chains into dropping everything but the first hit.
+func removeFlams(group []*pb.MidiNote, flamMin, flamMax float64, keepFlams bool) []*pb.MidiNote {
+	if keepFlams || len(group) < 2 {
+		return group
+	}
+
+	result := make([]*pb.MidiNote, 0, len(group))
+
+	i := 0
+	for i < len(group) {
+		if i+1 < len(group) {
+			gap := group[i+1].StartTime - group[i].StartTime
+			if gap >= flamMin && gap <= flamMax {
+				result = append(result, group[i])
+				i += 2
+				continue
+			}
+		}
+		result = append(result, group[i])
+		i++
+	}
+
+	return result
+}
+
+func abs32(n int32) int32 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
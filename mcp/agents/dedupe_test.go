@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+
+	pb "magica/mcp/proto/magica_daw"
+)
+
+func defaultDedupeOptions() *pb.DedupeOptions {
+	return &pb.DedupeOptions{EpsilonMs: 10, MergeStrategy: "max", FlamMinMs: 15, FlamMaxMs: 40}
+}
+
+func TestDedupeNotesExactDuplicatesMerge(t *testing.T) {
+	notes := []*pb.MidiNote{
+		{Pitch: 60, StartTime: 1.0, Duration: 0.5, Velocity: 90},
+		{Pitch: 60, StartTime: 1.0, Duration: 0.5, Velocity: 90},
+	}
+
+	result := dedupeNotes(notes, defaultDedupeOptions())
+
+	if len(result) != 1 {
+		t.Fatalf("expected exact duplicates to merge to 1 note, got %d", len(result))
+	}
+}
+
+func TestDedupeNotesJitteredDuplicatesMerge(t *testing.T) {
+	// 6ms apart, within the 10ms epsilon -- a double-triggered controller.
+	notes := []*pb.MidiNote{
+		{Pitch: 60, StartTime: 1.000, Duration: 0.5, Velocity: 90},
+		{Pitch: 60, StartTime: 1.006, Duration: 0.5, Velocity: 95},
+	}
+
+	result := dedupeNotes(notes, defaultDedupeOptions())
+
+	if len(result) != 1 {
+		t.Fatalf("expected jittered duplicates to merge to 1 note, got %d", len(result))
+	}
+	if result[0].Velocity != 95 {
+		t.Errorf("expected max-strategy merge to keep the louder velocity 95, got %d", result[0].Velocity)
+	}
+}
+
+func TestDedupeNotesIntentionalLayersSurvive(t *testing.T) {
+	// Same pitch and start time, but velocities far enough apart to be a
+	// deliberate layer rather than a duplicate.
+	notes := []*pb.MidiNote{
+		{Pitch: 60, StartTime: 1.0, Duration: 0.5, Velocity: 40},
+		{Pitch: 60, StartTime: 1.0, Duration: 0.5, Velocity: 120},
+	}
+
+	result := dedupeNotes(notes, defaultDedupeOptions())
+
+	if len(result) != 2 {
+		t.Fatalf("expected layered notes to survive deduplication, got %d notes", len(result))
+	}
+}
+
+func TestDedupeNotesLegatoRunSurvivesChaining(t *testing.T) {
+	// Five notes 8ms apart (epsilon=10ms): each is close to its neighbor,
+	// but the first and last are 32ms apart -- a legato/arpeggio run, not
+	// a single intentional duplicate. Clustering must anchor to each
+	// cluster's first note, not chain off the last one added.
+	notes := []*pb.MidiNote{
+		{Pitch: 60, StartTime: 0.000, Duration: 0.1, Velocity: 90},
+		{Pitch: 60, StartTime: 0.008, Duration: 0.1, Velocity: 90},
+		{Pitch: 60, StartTime: 0.016, Duration: 0.1, Velocity: 90},
+		{Pitch: 60, StartTime: 0.024, Duration: 0.1, Velocity: 90},
+		{Pitch: 60, StartTime: 0.032, Duration: 0.1, Velocity: 90},
+	}
+
+	result := dedupeNotes(notes, defaultDedupeOptions())
+
+	if len(result) == 1 {
+		t.Fatalf("expected the 32ms-long run to survive as more than 1 note, got %d", len(result))
+	}
+}
+
+func TestDedupeNotesCrescendoSurvivesVelocityChaining(t *testing.T) {
+	// Coincident notes stepping up 10 velocity at a time (layerVelocityThreshold=20):
+	// each step is within threshold of its neighbor, but the first and
+	// last are 40 apart end-to-end -- a deliberate crescendo layer, not a
+	// near-duplicate.
+	notes := []*pb.MidiNote{
+		{Pitch: 60, StartTime: 1.0, Duration: 0.5, Velocity: 90},
+		{Pitch: 60, StartTime: 1.0, Duration: 0.5, Velocity: 100},
+		{Pitch: 60, StartTime: 1.0, Duration: 0.5, Velocity: 110},
+		{Pitch: 60, StartTime: 1.0, Duration: 0.5, Velocity: 120},
+		{Pitch: 60, StartTime: 1.0, Duration: 0.5, Velocity: 130},
+	}
+
+	result := dedupeNotes(notes, defaultDedupeOptions())
+
+	if len(result) == 1 {
+		t.Fatalf("expected the 40-velocity-spread crescendo to survive as more than 1 note, got %d", len(result))
+	}
+}
+
+func TestDedupeNotesDrumRollSurvivesFlamChaining(t *testing.T) {
+	// Four same-pitch notes 20ms apart (inside the default 15-40ms flam
+	// window): a plain 16th-note drum roll, not a cascade of flams.
+	// Once a flam pair is consumed, the next candidate is compared against
+	// the note after the pair (not against the note just dropped), so the
+	// whole run must not collapse down to one note.
+	notes := []*pb.MidiNote{
+		{Pitch: 60, StartTime: 1.000, Duration: 0.1, Velocity: 90},
+		{Pitch: 60, StartTime: 1.020, Duration: 0.1, Velocity: 90},
+		{Pitch: 60, StartTime: 1.040, Duration: 0.1, Velocity: 90},
+		{Pitch: 60, StartTime: 1.060, Duration: 0.1, Velocity: 90},
+	}
+
+	result := dedupeNotes(notes, defaultDedupeOptions())
+
+	if len(result) == 1 {
+		t.Fatalf("expected the drum roll to survive as more than 1 note, got %d", len(result))
+	}
+}
+
+func TestDedupeNotesFlamsRemovedByDefault(t *testing.T) {
+	// 25ms apart -- inside the flam window but outside the dedupe epsilon.
+	notes := []*pb.MidiNote{
+		{Pitch: 60, StartTime: 1.000, Duration: 0.5, Velocity: 90},
+		{Pitch: 60, StartTime: 1.025, Duration: 0.5, Velocity: 90},
+	}
+
+	result := dedupeNotes(notes, defaultDedupeOptions())
+
+	if len(result) != 1 {
+		t.Fatalf("expected flam to be collapsed to 1 note, got %d", len(result))
+	}
+}
+
+func TestDedupeNotesFlamsKeptWhenRequested(t *testing.T) {
+	notes := []*pb.MidiNote{
+		{Pitch: 60, StartTime: 1.000, Duration: 0.5, Velocity: 90},
+		{Pitch: 60, StartTime: 1.025, Duration: 0.5, Velocity: 90},
+	}
+
+	opts := defaultDedupeOptions()
+	opts.KeepFlams = true
+	result := dedupeNotes(notes, opts)
+
+	if len(result) != 2 {
+		t.Fatalf("expected flam to be kept when -keep-flams is set, got %d notes", len(result))
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	pb "magica/mcp/proto/magica_daw"
+)
+
+// revision is a single pre-change snapshot of a clip's notes, tagged with
+// a monotonically-increasing revision number for that clip.
+type revision struct {
+	Revision int            `json:"revision"`
+	Notes    []*pb.MidiNote `json:"notes"`
+}
+
+// historyState is the on-disk representation of the history store: an
+// undo stack and a redo stack per clip, each capped to maxDepth entries.
+type historyState struct {
+	Undo map[string][]revision `json:"undo"`
+	Redo map[string][]revision `json:"redo"`
+	Next map[string]int        `json:"next"`
+}
+
+// historyStore makes mutating utility ops reversible. Each mutating op
+// snapshots the clip's pre-change notes before it runs; UndoLast restores
+// the most recent snapshot and pushes the current state onto the redo
+// stack, and RedoLast reverses that. The store is persisted to a JSON
+// file so history survives agent restarts.
+type historyStore struct {
+	mu       sync.Mutex
+	path     string
+	maxDepth int
+	state    historyState
+}
+
+func newHistoryStore(path string, maxDepth int) (*historyStore, error) {
+	h := &historyStore{
+		path:     path,
+		maxDepth: maxDepth,
+		state: historyState{
+			Undo: make(map[string][]revision),
+			Redo: make(map[string][]revision),
+			Next: make(map[string]int),
+		},
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history store: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &h.state); err != nil {
+		return nil, fmt.Errorf("failed to parse history store: %v", err)
+	}
+
+	return h, nil
+}
+
+// Snapshot records notes as the pre-change state for clipId, dropping the
+// oldest entry once the ring buffer reaches maxDepth, and clears the redo
+// stack since a fresh edit invalidates any previously undone state.
+func (h *historyStore) Snapshot(clipId string, notes []*pb.MidiNote) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	rev := h.state.Next[clipId]
+	h.state.Next[clipId] = rev + 1
+
+	entries := append(h.state.Undo[clipId], revision{Revision: rev, Notes: notes})
+	if h.maxDepth > 0 && len(entries) > h.maxDepth {
+		entries = entries[len(entries)-h.maxDepth:]
+	}
+	h.state.Undo[clipId] = entries
+	delete(h.state.Redo, clipId)
+
+	return h.persist()
+}
+
+// Undo pops the most recent snapshot for clipId, pushes currentNotes onto
+// the redo stack, and returns the notes to restore.
+func (h *historyStore) Undo(clipId string, currentNotes []*pb.MidiNote) ([]*pb.MidiNote, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries := h.state.Undo[clipId]
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no undo history for clip %s", clipId)
+	}
+
+	last := entries[len(entries)-1]
+	h.state.Undo[clipId] = entries[:len(entries)-1]
+
+	redoRev := h.state.Next[clipId]
+	h.state.Next[clipId] = redoRev + 1
+	h.state.Redo[clipId] = append(h.state.Redo[clipId], revision{Revision: redoRev, Notes: currentNotes})
+
+	if err := h.persist(); err != nil {
+		return nil, err
+	}
+
+	return last.Notes, nil
+}
+
+// Redo pops the most recently undone snapshot for clipId, pushes
+// currentNotes back onto the undo stack, and returns the notes to restore.
+func (h *historyStore) Redo(clipId string, currentNotes []*pb.MidiNote) ([]*pb.MidiNote, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries := h.state.Redo[clipId]
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no redo history for clip %s", clipId)
+	}
+
+	last := entries[len(entries)-1]
+	h.state.Redo[clipId] = entries[:len(entries)-1]
+	h.state.Undo[clipId] = append(h.state.Undo[clipId], revision{Revision: last.Revision, Notes: currentNotes})
+
+	if err := h.persist(); err != nil {
+		return nil, err
+	}
+
+	return last.Notes, nil
+}
+
+// persist must be called with h.mu held.
+func (h *historyStore) persist() error {
+	data, err := json.MarshalIndent(h.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal history store: %v", err)
+	}
+
+	if err := os.WriteFile(h.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write history store: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	pb "magica/mcp/proto/magica_daw"
+)
+
+func TestHistoryStoreUndoRedoRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	h, err := newHistoryStore(path, 10)
+	if err != nil {
+		t.Fatalf("newHistoryStore failed: %v", err)
+	}
+
+	before := []*pb.MidiNote{{Pitch: 60, StartTime: 0, Duration: 1, Velocity: 100}}
+	after := []*pb.MidiNote{{Pitch: 60, StartTime: 0, Duration: 1, Velocity: 100}, {Pitch: 62, StartTime: 1, Duration: 1, Velocity: 100}}
+
+	if err := h.Snapshot("clip-1", before); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	restored, err := h.Undo("clip-1", after)
+	if err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	if len(restored) != len(before) {
+		t.Fatalf("expected undo to restore %d notes, got %d", len(before), len(restored))
+	}
+
+	redone, err := h.Redo("clip-1", restored)
+	if err != nil {
+		t.Fatalf("Redo failed: %v", err)
+	}
+	if len(redone) != len(after) {
+		t.Fatalf("expected redo to restore %d notes, got %d", len(after), len(redone))
+	}
+}
+
+func TestHistoryStoreRingBufferCapsDepth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	h, err := newHistoryStore(path, 2)
+	if err != nil {
+		t.Fatalf("newHistoryStore failed: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		notes := []*pb.MidiNote{{Pitch: int32(i), StartTime: 0, Duration: 1, Velocity: 100}}
+		if err := h.Snapshot("clip-1", notes); err != nil {
+			t.Fatalf("Snapshot %d failed: %v", i, err)
+		}
+	}
+
+	if got := len(h.state.Undo["clip-1"]); got != 2 {
+		t.Errorf("expected ring buffer capped at 2 entries, got %d", got)
+	}
+}
+
+func TestHistoryStoreUndoOnlyRevertsOneOfMultipleSnapshots(t *testing.T) {
+	// CleanupRecording runs three mutating sub-operations, each of which
+	// snapshots separately. A single Undo should only revert the last of
+	// them, not the whole multi-step cleanup.
+	path := filepath.Join(t.TempDir(), "history.json")
+	h, err := newHistoryStore(path, 10)
+	if err != nil {
+		t.Fatalf("newHistoryStore failed: %v", err)
+	}
+
+	recorded := []*pb.MidiNote{{Pitch: 60, StartTime: 0, Duration: 0.02, Velocity: 100}}
+	shortNotesRemoved := []*pb.MidiNote{}
+	deduped := []*pb.MidiNote{{Pitch: 62, StartTime: 0, Duration: 0.5, Velocity: 100}}
+	quantized := []*pb.MidiNote{{Pitch: 62, StartTime: 0.25, Duration: 0.5, Velocity: 100}}
+
+	if err := h.Snapshot("clip-1", recorded); err != nil { // before short-note removal
+		t.Fatalf("Snapshot 1 failed: %v", err)
+	}
+	if err := h.Snapshot("clip-1", shortNotesRemoved); err != nil { // before dedup
+		t.Fatalf("Snapshot 2 failed: %v", err)
+	}
+	if err := h.Snapshot("clip-1", deduped); err != nil { // before quantization
+		t.Fatalf("Snapshot 3 failed: %v", err)
+	}
+
+	restored, err := h.Undo("clip-1", quantized)
+	if err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	if len(restored) != len(deduped) {
+		t.Fatalf("expected one Undo to only revert the quantization step (to %d notes), got %d", len(deduped), len(restored))
+	}
+
+	if got := len(h.state.Undo["clip-1"]); got != 2 {
+		t.Errorf("expected 2 earlier snapshots still undoable, got %d", got)
+	}
+}
+
+func TestHistoryStoreUndoWithNoHistoryErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	h, err := newHistoryStore(path, 10)
+	if err != nil {
+		t.Fatalf("newHistoryStore failed: %v", err)
+	}
+
+	if _, err := h.Undo("clip-nonexistent", nil); err == nil {
+		t.Error("expected error undoing a clip with no history")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+
+	pb "magica/mcp/proto/magica_daw"
+)
+
+const (
+	defaultPPQ             = 480
+	defaultTempoMicrosPerQ = 500000 // 120 BPM
+	metaSetTempo           = 0x51
+	metaTimeSignature      = 0x58
+	metaEndOfTrack         = 0x2F
+)
+
+// tempoChange is a SetTempo meta event parsed from (or written to) a
+// track, anchored to an absolute tick offset.
+type tempoChange struct {
+	Tick             uint32
+	MicrosPerQuarter uint32
+}
+
+// timeSigChange is a time-signature meta event anchored to an absolute
+// tick offset.
+type timeSigChange struct {
+	Tick        uint32
+	Numerator   uint8
+	Denominator uint8 // as a power-of-two exponent, per the SMF spec
+}
+
+// smfFile is the subset of a Standard MIDI File this agent round-trips:
+// a PPQ division, the tempo/time-signature map needed to parse a track
+// correctly, and the note events themselves.
+type smfFile struct {
+	Format   uint16
+	PPQ      uint16
+	Tempos   []tempoChange
+	TimeSigs []timeSigChange
+	Notes    []*pb.MidiNote
+}
+
+// notesToSMF builds a Type-0 Standard MIDI File from the DAW's beat-based
+// notes. One beat is one quarter note, so ticks = beats * ppq.
+func notesToSMF(notes []*pb.MidiNote, ppq uint16) *smfFile {
+	return &smfFile{
+		Format:   0,
+		PPQ:      ppq,
+		Tempos:   []tempoChange{{Tick: 0, MicrosPerQuarter: defaultTempoMicrosPerQ}},
+		TimeSigs: []timeSigChange{{Tick: 0, Numerator: 4, Denominator: 2}},
+		Notes:    notes,
+	}
+}
+
+// WriteFile serializes f as a Type-0 SMF to path.
+func (f *smfFile) WriteFile(path string) error {
+	var track bytes.Buffer
+
+	type tickEvent struct {
+		tick  uint32
+		bytes []byte
+	}
+	var events []tickEvent
+
+	for _, tc := range f.Tempos {
+		data := []byte{
+			byte(tc.MicrosPerQuarter >> 16),
+			byte(tc.MicrosPerQuarter >> 8),
+			byte(tc.MicrosPerQuarter),
+		}
+		events = append(events, tickEvent{tc.Tick, metaEvent(metaSetTempo, data)})
+	}
+	for _, ts := range f.TimeSigs {
+		data := []byte{ts.Numerator, ts.Denominator, 24, 8}
+		events = append(events, tickEvent{ts.Tick, metaEvent(metaTimeSignature, data)})
+	}
+
+	ppq := float64(f.PPQ)
+	for _, n := range f.Notes {
+		startTick := uint32(n.StartTime * ppq)
+		endTick := uint32((n.StartTime + n.Duration) * ppq)
+		velocity := byte(n.Velocity)
+		events = append(events, tickEvent{startTick, channelEvent(0x90, byte(n.Pitch), velocity)})
+		events = append(events, tickEvent{endTick, channelEvent(0x80, byte(n.Pitch), 0)})
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].tick < events[j].tick })
+
+	var lastTick uint32
+	for _, e := range events {
+		writeVarLen(&track, e.tick-lastTick)
+		track.Write(e.bytes)
+		lastTick = e.tick
+	}
+	writeVarLen(&track, 0)
+	track.Write(metaEvent(metaEndOfTrack, nil))
+
+	var out bytes.Buffer
+	out.WriteString("MThd")
+	binary.Write(&out, binary.BigEndian, uint32(6))
+	binary.Write(&out, binary.BigEndian, f.Format)
+	binary.Write(&out, binary.BigEndian, uint16(1))
+	binary.Write(&out, binary.BigEndian, f.PPQ)
+
+	out.WriteString("MTrk")
+	binary.Write(&out, binary.BigEndian, uint32(track.Len()))
+	out.Write(track.Bytes())
+
+	return os.WriteFile(path, out.Bytes(), 0644)
+}
+
+func metaEvent(metaType byte, data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(0xFF)
+	buf.WriteByte(metaType)
+	writeVarLen(&buf, uint32(len(data)))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func channelEvent(status, data1, data2 byte) []byte {
+	return []byte{status, data1, data2}
+}
+
+func writeVarLen(buf *bytes.Buffer, value uint32) {
+	var stack []byte
+	stack = append(stack, byte(value&0x7F))
+	value >>= 7
+	for value > 0 {
+		stack = append(stack, byte(value&0x7F)|0x80)
+		value >>= 7
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		buf.WriteByte(stack[i])
+	}
+}
+
+// readSMF parses a Type-0 or Type-1 Standard MIDI File, converting note
+// on/off pairs in every track to beat-based MidiNotes using the file's
+// PPQ. SetTempo and time-signature meta events are parsed (so the track
+// stream is consumed correctly) and kept on the returned file, though
+// beat position only depends on PPQ.
+func readSMF(path string) (*smfFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SMF file: %v", err)
+	}
+
+	r := bytes.NewReader(data)
+
+	var chunkId [4]byte
+	if _, err := r.Read(chunkId[:]); err != nil || string(chunkId[:]) != "MThd" {
+		return nil, fmt.Errorf("not a Standard MIDI File (missing MThd)")
+	}
+
+	var headerLen uint32
+	binary.Read(r, binary.BigEndian, &headerLen)
+
+	var format, ntrks, division uint16
+	binary.Read(r, binary.BigEndian, &format)
+	binary.Read(r, binary.BigEndian, &ntrks)
+	binary.Read(r, binary.BigEndian, &division)
+
+	if division&0x8000 != 0 {
+		return nil, fmt.Errorf("SMPTE time division is not supported")
+	}
+
+	f := &smfFile{Format: format, PPQ: division}
+	ppq := float64(division)
+
+	for t := 0; t < int(ntrks); t++ {
+		if _, err := r.Read(chunkId[:]); err != nil || string(chunkId[:]) != "MTrk" {
+			return nil, fmt.Errorf("malformed track %d (missing MTrk)", t)
+		}
+		var trackLen uint32
+		binary.Read(r, binary.BigEndian, &trackLen)
+
+		trackData := make([]byte, trackLen)
+		if _, err := r.Read(trackData); err != nil {
+			return nil, fmt.Errorf("failed to read track %d: %v", t, err)
+		}
+
+		notes, tempos, timeSigs, err := parseTrack(trackData, ppq)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse track %d: %v", t, err)
+		}
+		f.Notes = append(f.Notes, notes...)
+		f.Tempos = append(f.Tempos, tempos...)
+		f.TimeSigs = append(f.TimeSigs, timeSigs...)
+	}
+
+	return f, nil
+}
+
+func parseTrack(data []byte, ppq float64) ([]*pb.MidiNote, []tempoChange, []timeSigChange, error) {
+	type pendingNote struct {
+		startTick uint32
+		velocity  byte
+	}
+
+	var notes []*pb.MidiNote
+	var tempos []tempoChange
+	var timeSigs []timeSigChange
+	active := make(map[byte]pendingNote) // keyed by pitch; single-channel is assumed
+
+	pos := 0
+	var tick uint32
+	var runningStatus byte
+
+	readVarLen := func() uint32 {
+		var value uint32
+		for {
+			b := data[pos]
+			pos++
+			value = (value << 7) | uint32(b&0x7F)
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		return value
+	}
+
+	for pos < len(data) {
+		tick += readVarLen()
+
+		status := data[pos]
+		if status < 0x80 {
+			status = runningStatus
+		} else {
+			pos++
+			// Running status only applies to channel voice messages; a
+			// meta or sysex event must not become the implicit status
+			// used by a later channel event.
+			if status < 0xF0 {
+				runningStatus = status
+			}
+		}
+
+		switch {
+		case status == 0xFF:
+			metaType := data[pos]
+			pos++
+			length := readVarLen()
+			payload := data[pos : pos+int(length)]
+			pos += int(length)
+
+			switch metaType {
+			case metaSetTempo:
+				micros := uint32(payload[0])<<16 | uint32(payload[1])<<8 | uint32(payload[2])
+				tempos = append(tempos, tempoChange{Tick: tick, MicrosPerQuarter: micros})
+			case metaTimeSignature:
+				timeSigs = append(timeSigs, timeSigChange{Tick: tick, Numerator: payload[0], Denominator: payload[1]})
+			}
+
+		case status == 0xF0 || status == 0xF7:
+			length := readVarLen()
+			pos += int(length)
+
+		case status&0xF0 == 0x90 || status&0xF0 == 0x80:
+			pitch := data[pos]
+			velocity := data[pos+1]
+			pos += 2
+
+			isNoteOn := status&0xF0 == 0x90 && velocity > 0
+			if isNoteOn {
+				active[pitch] = pendingNote{startTick: tick, velocity: velocity}
+			} else if pending, ok := active[pitch]; ok {
+				delete(active, pitch)
+				notes = append(notes, &pb.MidiNote{
+					Pitch:     int32(pitch),
+					StartTime: float64(pending.startTick) / ppq,
+					Duration:  float64(tick-pending.startTick) / ppq,
+					Velocity:  int32(pending.velocity),
+				})
+			}
+
+		case status&0xF0 == 0xC0 || status&0xF0 == 0xD0:
+			pos += 1
+
+		case status&0xF0 >= 0xA0 && status&0xF0 <= 0xE0:
+			pos += 2
+
+		default:
+			return nil, nil, nil, fmt.Errorf("unsupported status byte 0x%X", status)
+		}
+	}
+
+	sort.Slice(notes, func(i, j int) bool { return notes[i].StartTime < notes[j].StartTime })
+	return notes, tempos, timeSigs, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "magica/mcp/proto/magica_daw"
+)
+
+func TestSMFRoundTripSurvivesCleanup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "roundtrip.mid")
+
+	original := []*pb.MidiNote{
+		{Pitch: 60, StartTime: 0, Duration: 0.5, Velocity: 100},
+		{Pitch: 64, StartTime: 0.5, Duration: 0.5, Velocity: 90},
+		{Pitch: 67, StartTime: 1.0, Duration: 1.0, Velocity: 110},
+	}
+
+	if err := notesToSMF(original, defaultPPQ).WriteFile(path); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	imported, err := readSMF(path)
+	if err != nil {
+		t.Fatalf("readSMF failed: %v", err)
+	}
+
+	cleaned := dedupeNotes(imported.Notes, defaultDedupeOptions())
+
+	if err := notesToSMF(cleaned, defaultPPQ).WriteFile(path); err != nil {
+		t.Fatalf("re-export WriteFile failed: %v", err)
+	}
+
+	exported, err := readSMF(path)
+	if err != nil {
+		t.Fatalf("readSMF on re-exported file failed: %v", err)
+	}
+
+	if len(exported.Notes) != len(original) {
+		t.Fatalf("expected %d notes to survive round-trip, got %d", len(original), len(exported.Notes))
+	}
+
+	tickTolerance := 1.0 / float64(defaultPPQ)
+	for i, note := range exported.Notes {
+		want := original[i]
+		if note.Pitch != want.Pitch {
+			t.Errorf("note %d: pitch changed from %d to %d", i, want.Pitch, note.Pitch)
+		}
+		if math.Abs(note.StartTime-want.StartTime) > tickTolerance {
+			t.Errorf("note %d: start time drifted from %.6f to %.6f", i, want.StartTime, note.StartTime)
+		}
+		if math.Abs(note.Duration-want.Duration) > tickTolerance {
+			t.Errorf("note %d: duration drifted from %.6f to %.6f", i, want.Duration, note.Duration)
+		}
+	}
+}
+
+// TestSMFRunningStatusNotResetByMetaEvent covers a track with an explicit
+// note-on, a mid-track SetTempo meta event, and then a note-off sent via
+// running status (no status byte). A meta event must not become the
+// running status, or the note-off gets parsed as a malformed meta event
+// and the note is silently dropped.
+func TestSMFRunningStatusNotResetByMetaEvent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "running-status.mid")
+
+	var track bytes.Buffer
+	writeVarLen(&track, 0)
+	track.Write(channelEvent(0x90, 60, 100)) // explicit note-on
+
+	writeVarLen(&track, uint32(defaultPPQ))
+	track.Write(metaEvent(metaSetTempo, []byte{0x07, 0xA1, 0x20})) // mid-track tempo change
+
+	writeVarLen(&track, uint32(defaultPPQ))
+	track.Write([]byte{60, 0}) // note-off via running status (0x90, velocity 0)
+
+	writeVarLen(&track, 0)
+	track.Write(metaEvent(metaEndOfTrack, nil))
+
+	var out bytes.Buffer
+	out.WriteString("MThd")
+	binary.Write(&out, binary.BigEndian, uint32(6))
+	binary.Write(&out, binary.BigEndian, uint16(0))
+	binary.Write(&out, binary.BigEndian, uint16(1))
+	binary.Write(&out, binary.BigEndian, uint16(defaultPPQ))
+	out.WriteString("MTrk")
+	binary.Write(&out, binary.BigEndian, uint32(track.Len()))
+	out.Write(track.Bytes())
+
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+
+	smf, err := readSMF(path)
+	if err != nil {
+		t.Fatalf("readSMF failed: %v", err)
+	}
+
+	if len(smf.Notes) != 1 {
+		t.Fatalf("expected 1 note to survive the mid-track tempo change, got %d", len(smf.Notes))
+	}
+	if got := smf.Notes[0].Duration; math.Abs(got-2.0) > 1e-6 {
+		t.Errorf("expected note duration 2.0 beats, got %.6f", got)
+	}
+}
@@ -2,24 +2,63 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 
+	"magica/mcp/internal/metrics"
 	pb "magica/mcp/proto/magica_daw"
 )
 
+// agentMetrics holds every Prometheus metric this agent exposes on
+// -metrics-addr.
+type agentMetrics struct {
+	registry         *metrics.Registry
+	notesRemoved     *metrics.Counter // labeled by operation: dedup, short_note_filter
+	eventsReceived   *metrics.Counter // labeled by event_type
+	opLatencySeconds *metrics.Histogram
+	clipSizeNotes    *metrics.Histogram
+	queuedJobs       *metrics.Gauge
+	inFlightJobs     *metrics.Gauge
+}
+
+func newAgentMetrics() *agentMetrics {
+	registry := metrics.NewRegistry()
+	return &agentMetrics{
+		registry:         registry,
+		notesRemoved:     registry.NewCounter("magica_utility_notes_removed_total", "Notes removed by dedup and short-note filter operations", "operation"),
+		eventsReceived:   registry.NewCounter("magica_utility_events_received_total", "DAW events received", "event_type"),
+		opLatencySeconds: registry.NewHistogram("magica_utility_op_latency_seconds", "Latency of utility operations", []float64{0.001, 0.01, 0.05, 0.1, 0.5, 1, 5}),
+		clipSizeNotes:    registry.NewHistogram("magica_utility_clip_size_notes", "Number of notes processed per operation", []float64{1, 10, 50, 100, 500, 1000}),
+		queuedJobs:       registry.NewGauge("magica_utility_cleanup_jobs_queued", "Cleanup jobs waiting on their debounce window"),
+		inFlightJobs:     registry.NewGauge("magica_utility_cleanup_jobs_in_flight", "Cleanup jobs currently running"),
+	}
+}
+
 type UtilityAgent struct {
-	client  pb.MagdaDAWServiceClient
-	agentId string
-	dawConn *grpc.ClientConn
+	client        pb.MagdaDAWServiceClient
+	agentId       string
+	dawConn       *grpc.ClientConn
+	cleanup       *cleanupQueue
+	history       *historyStore
+	logger        *slog.Logger
+	metrics       *agentMetrics
+	metricsServer *metrics.Server
 }
 
-func NewUtilityAgent(dawAddress string) (*UtilityAgent, error) {
+func NewUtilityAgent(dawAddress string, historyPath string, historyDepth int, metricsAddr string, logger *slog.Logger) (*UtilityAgent, error) {
 	// Connect to Magda DAW
 	conn, err := grpc.Dial(dawAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
@@ -28,9 +67,32 @@ func NewUtilityAgent(dawAddress string) (*UtilityAgent, error) {
 
 	client := pb.NewMagdaDAWServiceClient(conn)
 
+	history, err := newHistoryStore(historyPath, historyDepth)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open history store: %v", err)
+	}
+
+	agentMetrics := newAgentMetrics()
+
 	agent := &UtilityAgent{
 		client:  client,
 		dawConn: conn,
+		history: history,
+		logger:  logger,
+		metrics: agentMetrics,
+	}
+
+	if metricsAddr != "" {
+		agent.metricsServer = metrics.NewServer(metricsAddr, agentMetrics.registry)
+		errCh := make(chan error, 1)
+		agent.metricsServer.Start(errCh)
+		go func() {
+			if err := <-errCh; err != nil {
+				logger.Error("metrics server failed", "error", err)
+			}
+		}()
+		logger.Info("metrics server listening", "addr", metricsAddr)
 	}
 
 	// Register with DAW
@@ -52,6 +114,8 @@ func (a *UtilityAgent) register() error {
 			"quantize_notes",
 			"normalize_velocity",
 			"cleanup_recording",
+			"import_smf",
+			"export_smf",
 		},
 	}
 
@@ -65,12 +129,13 @@ func (a *UtilityAgent) register() error {
 	}
 
 	a.agentId = resp.AgentId
-	fmt.Printf("✓ Registered as agent: %s\n", a.agentId)
+	a.logger.Info("registered with DAW", "agent_id", a.agentId)
 	return nil
 }
 
-func (a *UtilityAgent) DeduplicateClip(clipId string) error {
-	fmt.Printf("🧹 Deduplicating notes in clip: %s\n", clipId)
+func (a *UtilityAgent) DeduplicateClip(clipId string, opts *pb.DedupeOptions) error {
+	start := time.Now()
+	a.logger.Info("deduplicating clip", "clip_id", clipId)
 
 	// 1. Get current notes
 	getReq := &pb.GetMidiClipNotesRequest{ClipId: clipId}
@@ -80,29 +145,24 @@ func (a *UtilityAgent) DeduplicateClip(clipId string) error {
 	}
 
 	originalCount := len(getResp.Notes)
-	fmt.Printf("   📝 Original notes: %d\n", originalCount)
-
-	// 2. Deduplicate using map for O(1) lookup
-	seen := make(map[string]bool)
-	var uniqueNotes []*pb.MidiNote
+	a.metrics.clipSizeNotes.Observe(float64(originalCount))
 
-	for _, note := range getResp.Notes {
-		// Create unique key: pitch + start time (rounded to avoid float precision issues)
-		key := fmt.Sprintf("%d_%.3f", note.Pitch, math.Round(note.StartTime*1000)/1000)
-
-		if !seen[key] {
-			seen[key] = true
-			uniqueNotes = append(uniqueNotes, note)
-		}
+	if err := a.history.Snapshot(clipId, getResp.Notes); err != nil {
+		return fmt.Errorf("failed to snapshot history: %v", err)
 	}
 
+	// 2. Cluster near-duplicates by pitch/start-time proximity, then
+	// resolve flams
+	uniqueNotes := dedupeNotes(getResp.Notes, opts)
+
 	removedCount := originalCount - len(uniqueNotes)
-	fmt.Printf("   🗑️  Removed duplicates: %d\n", removedCount)
+	a.metrics.notesRemoved.Add("dedup", float64(removedCount))
 
 	// 3. Update clip with deduplicated notes
 	updateReq := &pb.UpdateMidiClipNotesRequest{
-		ClipId: clipId,
-		Notes:  uniqueNotes,
+		ClipId:        clipId,
+		Notes:         uniqueNotes,
+		DedupeOptions: opts,
 	}
 
 	updateResp, err := a.client.UpdateMidiClipNotes(context.Background(), updateReq)
@@ -114,12 +174,14 @@ func (a *UtilityAgent) DeduplicateClip(clipId string) error {
 		return fmt.Errorf("update failed")
 	}
 
-	fmt.Printf("   ✅ Deduplication complete: %d notes remaining\n", len(uniqueNotes))
+	a.metrics.opLatencySeconds.Observe(time.Since(start).Seconds())
+	a.logger.Info("deduplication complete", "clip_id", clipId, "removed", removedCount, "remaining", len(uniqueNotes))
 	return nil
 }
 
 func (a *UtilityAgent) RemoveShortNotes(clipId string, minDuration float64) error {
-	fmt.Printf("✂️  Removing notes shorter than %.3f beats in clip: %s\n", minDuration, clipId)
+	start := time.Now()
+	a.logger.Info("removing short notes", "clip_id", clipId, "min_duration_beats", minDuration)
 
 	// Get current notes
 	getReq := &pb.GetMidiClipNotesRequest{ClipId: clipId}
@@ -129,6 +191,11 @@ func (a *UtilityAgent) RemoveShortNotes(clipId string, minDuration float64) erro
 	}
 
 	originalCount := len(getResp.Notes)
+	a.metrics.clipSizeNotes.Observe(float64(originalCount))
+
+	if err := a.history.Snapshot(clipId, getResp.Notes); err != nil {
+		return fmt.Errorf("failed to snapshot history: %v", err)
+	}
 
 	// Filter out short notes
 	var filteredNotes []*pb.MidiNote
@@ -139,7 +206,7 @@ func (a *UtilityAgent) RemoveShortNotes(clipId string, minDuration float64) erro
 	}
 
 	removedCount := originalCount - len(filteredNotes)
-	fmt.Printf("   🗑️  Removed short notes: %d\n", removedCount)
+	a.metrics.notesRemoved.Add("short_note_filter", float64(removedCount))
 
 	// Update clip
 	updateReq := &pb.UpdateMidiClipNotesRequest{
@@ -156,33 +223,233 @@ func (a *UtilityAgent) RemoveShortNotes(clipId string, minDuration float64) erro
 		return fmt.Errorf("update failed")
 	}
 
-	fmt.Printf("   ✅ Short note removal complete: %d notes remaining\n", len(filteredNotes))
+	a.metrics.opLatencySeconds.Observe(time.Since(start).Seconds())
+	a.logger.Info("short note removal complete", "clip_id", clipId, "removed", removedCount, "remaining", len(filteredNotes))
 	return nil
 }
 
-func (a *UtilityAgent) QuantizeClip(clipId string, gridSize float64) error {
-	fmt.Printf("📐 Quantizing clip %s to %.3f beat grid\n", clipId, gridSize)
+// GrooveOffset is a single entry in a groove template: the timing and
+// velocity nudge applied to the note falling on a given grid subdivision
+// within the template's cycle (e.g. one bar of 16th notes).
+type GrooveOffset struct {
+	Step        int     `json:"step"`
+	TimingMs    float64 `json:"timing_ms"`
+	VelocityAdj int32   `json:"velocity_adj"`
+}
+
+// GrooveTemplate is a reusable timing/velocity feel extracted from a
+// reference clip or loaded from a JSON groove template file; Standard MIDI
+// groove files are not read. Offsets repeat every len(Offsets) grid steps.
+type GrooveTemplate struct {
+	Offsets []GrooveOffset `json:"offsets"`
+}
+
+func loadGrooveTemplate(path string) (*GrooveTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read groove template: %v", err)
+	}
+
+	var tmpl GrooveTemplate
+	if err := json.Unmarshal(data, &tmpl); err != nil {
+		return nil, fmt.Errorf("failed to parse groove template: %v", err)
+	}
+
+	return &tmpl, nil
+}
+
+// grooveCycleSteps is the number of grid steps a groove template cycles
+// over when extracted from a reference clip: one bar of 16th notes.
+const grooveCycleSteps = 16
+
+// extractGrooveTemplate derives a GrooveTemplate from a reference clip's
+// notes by measuring, for each grid step, how far its notes actually fall
+// from the grid line and how their velocity deviates from the clip's
+// average. Notes are bucketed by step modulo cycleSteps and averaged, so a
+// multi-bar reference clip yields one repeating per-bar feel.
+func extractGrooveTemplate(notes []*pb.MidiNote, grid float64, cycleSteps int) *GrooveTemplate {
+	if grid <= 0 {
+		grid = 0.25
+	}
+	if cycleSteps <= 0 {
+		cycleSteps = grooveCycleSteps
+	}
+
+	var velocitySum int64
+	for _, note := range notes {
+		velocitySum += int64(note.Velocity)
+	}
+	var avgVelocity float64
+	if len(notes) > 0 {
+		avgVelocity = float64(velocitySum) / float64(len(notes))
+	}
+
+	type bucket struct {
+		timingMsSum    float64
+		velocityAdjSum int64
+		count          int
+	}
+	buckets := make([]bucket, cycleSteps)
+
+	for _, note := range notes {
+		step := int(math.Round(note.StartTime / grid))
+		idx := ((step % cycleSteps) + cycleSteps) % cycleSteps
+		target := float64(step) * grid
+
+		b := &buckets[idx]
+		b.timingMsSum += (note.StartTime - target) * 1000
+		b.velocityAdjSum += int64(math.Round(float64(note.Velocity) - avgVelocity))
+		b.count++
+	}
 
-	quantizeReq := &pb.QuantizeClipRequest{
-		ClipId:   clipId,
-		GridSize: gridSize,
+	offsets := make([]GrooveOffset, cycleSteps)
+	for i, b := range buckets {
+		offsets[i] = GrooveOffset{Step: i}
+		if b.count == 0 {
+			continue
+		}
+		offsets[i].TimingMs = b.timingMsSum / float64(b.count)
+		offsets[i].VelocityAdj = int32(b.velocityAdjSum / int64(b.count))
 	}
 
-	resp, err := a.client.QuantizeClip(context.Background(), quantizeReq)
+	return &GrooveTemplate{Offsets: offsets}
+}
+
+// extractGrooveFromClip fetches referenceClipId's notes and derives a
+// GrooveTemplate from their timing/velocity deviation against grid.
+func (a *UtilityAgent) extractGrooveFromClip(referenceClipId string, grid float64) (*GrooveTemplate, error) {
+	getResp, err := a.client.GetMidiClipNotes(context.Background(), &pb.GetMidiClipNotesRequest{ClipId: referenceClipId})
 	if err != nil {
-		return fmt.Errorf("failed to quantize: %v", err)
+		return nil, fmt.Errorf("failed to get reference clip notes: %v", err)
 	}
 
-	if !resp.Success {
-		return fmt.Errorf("quantization failed")
+	return extractGrooveTemplate(getResp.Notes, grid, grooveCycleSteps), nil
+}
+
+// offsetForStep returns the groove offset for the grid step a note falls
+// on, cycling through the template if it is shorter than the clip.
+func (t *GrooveTemplate) offsetForStep(step int) GrooveOffset {
+	if t == nil || len(t.Offsets) == 0 {
+		return GrooveOffset{}
+	}
+	return t.Offsets[((step%len(t.Offsets))+len(t.Offsets))%len(t.Offsets)]
+}
+
+// quantizeNotes moves each note a fraction (opts.Strength) of the way to
+// its nearest grid line, applying swing to off-beat subdivisions and, if
+// a groove template is loaded, the template's per-step timing/velocity
+// feel. Strength 0 is a no-op; strength 1 matches hard-snap quantization.
+func quantizeNotes(notes []*pb.MidiNote, opts *pb.QuantizeOptions, groove *GrooveTemplate) []*pb.MidiNote {
+	grid := opts.Grid
+	if grid <= 0 {
+		grid = 0.25
+	}
+
+	quantized := make([]*pb.MidiNote, len(notes))
+	for i, note := range notes {
+		note := *note
+		step := int(math.Round(note.StartTime / grid))
+
+		target := float64(step) * grid
+		if step%2 != 0 {
+			target += opts.Swing * grid
+		}
+
+		if groove != nil {
+			target += groove.offsetForStep(step).TimingMs / 1000
+		}
+
+		if opts.RandomizeMs > 0 {
+			target += (rand.Float64()*2 - 1) * (opts.RandomizeMs / 1000)
+		}
+
+		note.StartTime += (target - note.StartTime) * opts.Strength
+
+		if !opts.PreserveVelocity && groove != nil {
+			adj := int32(float64(groove.offsetForStep(step).VelocityAdj) * opts.Strength)
+			note.Velocity = clampVelocity(note.Velocity + adj)
+		}
+
+		quantized[i] = &note
+	}
+
+	return quantized
+}
+
+// clampVelocity keeps a groove-adjusted velocity within the legal MIDI data
+// byte range. 0 is reserved for note-off, so the floor is 1.
+func clampVelocity(v int32) int32 {
+	switch {
+	case v < 1:
+		return 1
+	case v > 127:
+		return 127
+	default:
+		return v
+	}
+}
+
+// QuantizeClip quantizes clipId's notes to opts.Grid. If grooveReferenceClipId
+// is set, the groove template is extracted from that clip's own notes
+// instead of opts.GrooveTemplateId's file.
+func (a *UtilityAgent) QuantizeClip(clipId string, opts *pb.QuantizeOptions, grooveReferenceClipId string) error {
+	start := time.Now()
+	a.logger.Info("quantizing clip", "clip_id", clipId, "grid", opts.Grid, "swing", opts.Swing, "strength", opts.Strength)
+
+	getReq := &pb.GetMidiClipNotesRequest{ClipId: clipId}
+	getResp, err := a.client.GetMidiClipNotes(context.Background(), getReq)
+	if err != nil {
+		return fmt.Errorf("failed to get notes: %v", err)
+	}
+	a.metrics.clipSizeNotes.Observe(float64(len(getResp.Notes)))
+
+	if err := a.history.Snapshot(clipId, getResp.Notes); err != nil {
+		return fmt.Errorf("failed to snapshot history: %v", err)
+	}
+
+	var groove *GrooveTemplate
+	switch {
+	case grooveReferenceClipId != "":
+		groove, err = a.extractGrooveFromClip(grooveReferenceClipId, opts.Grid)
+		if err != nil {
+			return err
+		}
+	case opts.GrooveTemplateId != "":
+		groove, err = loadGrooveTemplate(opts.GrooveTemplateId)
+		if err != nil {
+			return err
+		}
+	}
+
+	quantized := quantizeNotes(getResp.Notes, opts, groove)
+
+	updateReq := &pb.UpdateMidiClipNotesRequest{
+		ClipId: clipId,
+		Notes:  quantized,
+	}
+
+	updateResp, err := a.client.UpdateMidiClipNotes(context.Background(), updateReq)
+	if err != nil {
+		return fmt.Errorf("failed to update notes: %v", err)
 	}
 
-	fmt.Printf("   ✅ Quantization complete\n")
+	if !updateResp.Success {
+		return fmt.Errorf("update failed")
+	}
+
+	a.metrics.opLatencySeconds.Observe(time.Since(start).Seconds())
+	a.logger.Info("quantization complete", "clip_id", clipId)
 	return nil
 }
 
+// CleanupRecording runs the standard post-recording pipeline: short-note
+// removal, deduplication, then light quantization. Each sub-operation
+// snapshots its own pre-change state, so undo reverts this in three steps
+// (quantization, then dedup, then short-note removal) rather than all at
+// once — a single -action undo after -action cleanup only reverts the
+// quantization pass.
 func (a *UtilityAgent) CleanupRecording(clipId string) error {
-	fmt.Printf("🎯 Full cleanup process for clip: %s\n", clipId)
+	a.logger.Info("starting full cleanup", "clip_id", clipId)
 
 	// 1. Remove very short notes (likely accidents)
 	if err := a.RemoveShortNotes(clipId, 0.05); err != nil {
@@ -190,21 +457,243 @@ func (a *UtilityAgent) CleanupRecording(clipId string) error {
 	}
 
 	// 2. Deduplicate
-	if err := a.DeduplicateClip(clipId); err != nil {
+	dedupeOpts := &pb.DedupeOptions{EpsilonMs: 10, MergeStrategy: "max", FlamMinMs: 15, FlamMaxMs: 40}
+	if err := a.DeduplicateClip(clipId, dedupeOpts); err != nil {
 		return fmt.Errorf("deduplication failed: %v", err)
 	}
 
 	// 3. Light quantization (16th note grid)
-	if err := a.QuantizeClip(clipId, 0.25); err != nil {
+	if err := a.QuantizeClip(clipId, &pb.QuantizeOptions{Grid: 0.25, Strength: 1.0}, ""); err != nil {
 		return fmt.Errorf("quantization failed: %v", err)
 	}
 
-	fmt.Printf("🎉 Recording cleanup complete for clip: %s\n", clipId)
+	a.logger.Info("cleanup complete", "clip_id", clipId)
+	return nil
+}
+
+// UndoLast reverts clipId to the note list it had before its most recent
+// mutating operation, pushing the current state onto the redo stack.
+func (a *UtilityAgent) UndoLast(clipId string) error {
+	getReq := &pb.GetMidiClipNotesRequest{ClipId: clipId}
+	getResp, err := a.client.GetMidiClipNotes(context.Background(), getReq)
+	if err != nil {
+		return fmt.Errorf("failed to get notes: %v", err)
+	}
+
+	restored, err := a.history.Undo(clipId, getResp.Notes)
+	if err != nil {
+		return fmt.Errorf("undo failed: %v", err)
+	}
+
+	updateResp, err := a.client.UpdateMidiClipNotes(context.Background(), &pb.UpdateMidiClipNotesRequest{
+		ClipId: clipId,
+		Notes:  restored,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update notes: %v", err)
+	}
+	if !updateResp.Success {
+		return fmt.Errorf("update failed")
+	}
+
+	a.logger.Info("undo complete", "clip_id", clipId, "restored_notes", len(restored))
+	return nil
+}
+
+// RedoLast reapplies the most recently undone operation for clipId.
+func (a *UtilityAgent) RedoLast(clipId string) error {
+	getReq := &pb.GetMidiClipNotesRequest{ClipId: clipId}
+	getResp, err := a.client.GetMidiClipNotes(context.Background(), getReq)
+	if err != nil {
+		return fmt.Errorf("failed to get notes: %v", err)
+	}
+
+	restored, err := a.history.Redo(clipId, getResp.Notes)
+	if err != nil {
+		return fmt.Errorf("redo failed: %v", err)
+	}
+
+	updateResp, err := a.client.UpdateMidiClipNotes(context.Background(), &pb.UpdateMidiClipNotesRequest{
+		ClipId: clipId,
+		Notes:  restored,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update notes: %v", err)
+	}
+	if !updateResp.Success {
+		return fmt.Errorf("update failed")
+	}
+
+	a.logger.Info("redo complete", "clip_id", clipId, "restored_notes", len(restored))
+	return nil
+}
+
+// ImportSMF reads a Type-0 or Type-1 Standard MIDI File and creates a new
+// clip on trackId from its note events.
+func (a *UtilityAgent) ImportSMF(path string, trackId string) (string, error) {
+	a.logger.Info("importing SMF", "path", path, "track_id", trackId)
+
+	smf, err := readSMF(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to import SMF: %v", err)
+	}
+
+	createResp, err := a.client.CreateMidiClip(context.Background(), &pb.CreateMidiClipRequest{
+		TrackId: trackId,
+		Notes:   smf.Notes,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create clip: %v", err)
+	}
+	if !createResp.Success {
+		return "", fmt.Errorf("clip creation failed")
+	}
+
+	a.logger.Info("SMF import complete", "clip_id", createResp.ClipId, "notes", len(smf.Notes))
+	return createResp.ClipId, nil
+}
+
+// ExportSMF writes clipId's notes out as a Type-0 Standard MIDI File.
+func (a *UtilityAgent) ExportSMF(clipId string, path string) error {
+	a.logger.Info("exporting SMF", "clip_id", clipId, "path", path)
+
+	getResp, err := a.client.GetMidiClipNotes(context.Background(), &pb.GetMidiClipNotesRequest{ClipId: clipId})
+	if err != nil {
+		return fmt.Errorf("failed to get notes: %v", err)
+	}
+
+	smf := notesToSMF(getResp.Notes, defaultPPQ)
+	if err := smf.WriteFile(path); err != nil {
+		return fmt.Errorf("failed to export SMF: %v", err)
+	}
+
+	a.logger.Info("SMF export complete", "clip_id", clipId, "notes", len(getResp.Notes))
 	return nil
 }
 
-func (a *UtilityAgent) StartEventListener() {
-	fmt.Printf("👂 Starting event listener...\n")
+// recordingStoppedEventData is the JSON schema shared with the DAW for
+// RECORDING_STOPPED events.
+type recordingStoppedEventData struct {
+	ClipId string `json:"clip_id"`
+}
+
+// cleanupJob is a single queued, cancellable cleanup job. Re-enqueuing the
+// same clip ID cancels any job still waiting out its debounce window, so
+// repeated RECORDING_STOPPED events on one clip coalesce into one run.
+type cleanupJob struct {
+	Identifier string
+	ClipId     string
+	cancel     context.CancelFunc
+}
+
+// Cancel aborts the job if it is still debouncing or has not yet started.
+func (j *cleanupJob) Cancel() {
+	j.cancel()
+}
+
+// cleanupQueue debounces RECORDING_STOPPED events per clip and fans the
+// resulting jobs out to a bounded worker pool.
+type cleanupQueue struct {
+	debounce time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*cleanupJob
+
+	jobs    chan *cleanupJob
+	wg      sync.WaitGroup // debounce timers still running
+	workers sync.WaitGroup // in-flight worker goroutines
+
+	queuedGauge   *metrics.Gauge
+	inFlightGauge *metrics.Gauge
+}
+
+func newCleanupQueue(debounce time.Duration, workers int, queuedGauge, inFlightGauge *metrics.Gauge, handler func(job *cleanupJob)) *cleanupQueue {
+	q := &cleanupQueue{
+		debounce:      debounce,
+		pending:       make(map[string]*cleanupJob),
+		jobs:          make(chan *cleanupJob),
+		queuedGauge:   queuedGauge,
+		inFlightGauge: inFlightGauge,
+	}
+
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			for job := range q.jobs {
+				q.inFlightGauge.Add(1)
+				handler(job)
+				q.inFlightGauge.Add(-1)
+			}
+		}()
+	}
+
+	return q
+}
+
+// Enqueue debounces a cleanup for clipId, cancelling any job already
+// waiting for that clip.
+func (q *cleanupQueue) Enqueue(clipId string) *cleanupJob {
+	q.mu.Lock()
+	if existing, ok := q.pending[clipId]; ok {
+		existing.Cancel()
+	} else {
+		q.queuedGauge.Add(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &cleanupJob{
+		Identifier: fmt.Sprintf("%s-%d", clipId, time.Now().UnixNano()),
+		ClipId:     clipId,
+		cancel:     cancel,
+	}
+	q.pending[clipId] = job
+	q.mu.Unlock()
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(q.debounce):
+		}
+
+		q.mu.Lock()
+		if q.pending[clipId] == job {
+			delete(q.pending, clipId)
+		}
+		q.mu.Unlock()
+		q.queuedGauge.Add(-1)
+
+		select {
+		case q.jobs <- job:
+		case <-ctx.Done():
+		}
+	}()
+
+	return job
+}
+
+// Drain waits for any debouncing jobs to either fire or be cancelled,
+// then stops accepting new work and waits for in-flight workers to finish.
+func (q *cleanupQueue) Drain() {
+	q.wg.Wait()
+	close(q.jobs)
+	q.workers.Wait()
+}
+
+func (a *UtilityAgent) StartEventListener(workers int, debounce time.Duration) {
+	a.logger.Info("starting event listener", "workers", workers, "debounce", debounce)
+
+	a.cleanup = newCleanupQueue(debounce, workers, a.metrics.queuedJobs, a.metrics.inFlightJobs, func(job *cleanupJob) {
+		a.logger.Info("running debounced cleanup job", "job_id", job.Identifier, "clip_id", job.ClipId)
+		if err := a.CleanupRecording(job.ClipId); err != nil {
+			a.logger.Error("cleanup job failed", "job_id", job.Identifier, "error", err)
+			return
+		}
+		a.publishEvent("CLEANUP_COMPLETED", recordingStoppedEventData{ClipId: job.ClipId})
+	})
 
 	// Subscribe to relevant events
 	eventReq := &pb.AgentEventRequest{
@@ -218,13 +707,13 @@ func (a *UtilityAgent) StartEventListener() {
 
 	stream, err := a.client.AgentEventStream(context.Background())
 	if err != nil {
-		log.Printf("Failed to start event stream: %v", err)
+		a.logger.Error("failed to start event stream", "error", err)
 		return
 	}
 
 	// Send subscription request
 	if err := stream.Send(eventReq); err != nil {
-		log.Printf("Failed to subscribe to events: %v", err)
+		a.logger.Error("failed to subscribe to events", "error", err)
 		return
 	}
 
@@ -233,7 +722,7 @@ func (a *UtilityAgent) StartEventListener() {
 		for {
 			event, err := stream.Recv()
 			if err != nil {
-				log.Printf("Event stream error: %v", err)
+				a.logger.Error("event stream error", "error", err)
 				return
 			}
 
@@ -242,25 +731,68 @@ func (a *UtilityAgent) StartEventListener() {
 	}()
 }
 
+// publishEvent sends an event back through the DAW stream so other agents
+// can react to work this agent has completed.
+func (a *UtilityAgent) publishEvent(eventType string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		a.logger.Error("failed to marshal event data", "event_type", eventType, "error", err)
+		return
+	}
+
+	req := &pb.PublishEventRequest{
+		AgentId:   a.agentId,
+		EventType: eventType,
+		EventData: payload,
+	}
+
+	if _, err := a.client.PublishEvent(context.Background(), req); err != nil {
+		a.logger.Error("failed to publish event", "event_type", eventType, "error", err)
+	}
+}
+
 func (a *UtilityAgent) handleEvent(event *pb.AgentEventResponse) {
-	fmt.Printf("📨 Received event: %s\n", event.EventType)
+	a.metrics.eventsReceived.Inc(event.EventType)
+	a.logger.Info("received event", "event_type", event.EventType)
 
 	switch event.EventType {
 	case "RECORDING_STOPPED":
-		// Auto-cleanup recordings
-		fmt.Printf("🎤 Recording stopped, offering cleanup...\n")
-		// In a real implementation, you'd parse event.EventData to get clip ID
-		// and potentially offer automatic cleanup
+		var data recordingStoppedEventData
+		if err := json.Unmarshal(event.EventData, &data); err != nil {
+			a.logger.Error("failed to parse RECORDING_STOPPED event data", "error", err)
+			return
+		}
+		if data.ClipId == "" {
+			a.logger.Error("RECORDING_STOPPED event missing clip_id")
+			return
+		}
+
+		a.logger.Info("recording stopped, queueing cleanup", "clip_id", data.ClipId)
+		if a.cleanup != nil {
+			a.cleanup.Enqueue(data.ClipId)
+		}
 
 	case "CLIP_CREATED":
-		fmt.Printf("📝 New clip created\n")
+		a.logger.Info("new clip created")
 
 	case "TRACK_CREATED":
-		fmt.Printf("🎵 New track created\n")
+		a.logger.Info("new track created")
 	}
 }
 
+// Close drains any in-flight cleanup jobs, shuts the metrics server down,
+// and closes the DAW connection.
 func (a *UtilityAgent) Close() {
+	if a.cleanup != nil {
+		a.cleanup.Drain()
+	}
+	if a.metricsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := a.metricsServer.Close(ctx); err != nil {
+			a.logger.Error("failed to shut down metrics server", "error", err)
+		}
+	}
 	if a.dawConn != nil {
 		a.dawConn.Close()
 	}
@@ -269,28 +801,51 @@ func (a *UtilityAgent) Close() {
 func main() {
 	dawAddress := flag.String("daw", "localhost:50051", "Magda DAW server address")
 	clipId := flag.String("clip", "", "Clip ID to process (optional)")
-	action := flag.String("action", "listen", "Action: listen, cleanup, dedupe, quantize")
+	action := flag.String("action", "listen", "Action: listen, cleanup, dedupe, quantize, undo, redo, import-smf, export-smf")
+	grid := flag.Float64("grid", 0.25, "Quantize grid size in beats")
+	swing := flag.Float64("swing", 0.0, "Swing ratio applied to off-beat subdivisions (0-1)")
+	strength := flag.Float64("strength", 1.0, "Fraction of the way to move notes toward the grid (0-1)")
+	randomizeMs := flag.Float64("randomize-ms", 0.0, "Random timing jitter applied after quantization, in milliseconds")
+	grooveTemplate := flag.String("groove-template", "", "Path to a groove template file to apply")
+	grooveReferenceClip := flag.String("groove-reference-clip", "", "Clip ID to extract a groove template from instead of -groove-template")
+	preserveVelocity := flag.Bool("preserve-velocity", false, "Keep original note velocities instead of applying groove velocity offsets")
+	workers := flag.Int("workers", 4, "Number of concurrent cleanup workers for the listen action")
+	debounce := flag.Duration("debounce", 2*time.Second, "Debounce window for coalescing repeated RECORDING_STOPPED events per clip")
+	historyPath := flag.String("history-path", "./utility_history.json", "Path to the undo/redo history store")
+	historyDepth := flag.Int("history-depth", 20, "Maximum number of undo entries retained per clip")
+	dedupeEpsilonMs := flag.Float64("dedupe-epsilon-ms", 10, "Max gap in milliseconds between same-pitch notes merged as near-duplicates")
+	dedupeMergeStrategy := flag.String("dedupe-merge", "max", "Velocity merge strategy for clustered duplicates: max or mean")
+	flamMinMs := flag.Float64("flam-min-ms", 15, "Minimum gap in milliseconds considered a flam")
+	flamMaxMs := flag.Float64("flam-max-ms", 40, "Maximum gap in milliseconds considered a flam")
+	keepFlams := flag.Bool("keep-flams", false, "Keep flammed notes instead of removing the later one")
+	smfFilePath := flag.String("file", "", "Standard MIDI File path for import-smf/export-smf actions")
+	trackId := flag.String("track", "", "Track ID to import a Standard MIDI File onto")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on, e.g. :9090 (disabled if empty)")
 	flag.Parse()
 
-	fmt.Printf("🤖 Starting Utility Agent...\n")
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	logger.Info("starting utility agent")
 
 	// Connect to DAW
-	agent, err := NewUtilityAgent(*dawAddress)
+	agent, err := NewUtilityAgent(*dawAddress, *historyPath, *historyDepth, *metricsAddr, logger)
 	if err != nil {
 		log.Fatalf("Failed to create agent: %v", err)
 	}
 	defer agent.Close()
 
-	fmt.Printf("🔗 Connected to Magda DAW at %s\n", *dawAddress)
+	logger.Info("connected to DAW", "addr", *dawAddress)
 
 	// Handle different actions
 	switch *action {
 	case "listen":
-		fmt.Printf("👂 Listening for events... (Press Ctrl+C to exit)\n")
-		agent.StartEventListener()
+		logger.Info("listening for events (press Ctrl+C to exit)")
+		agent.StartEventListener(*workers, *debounce)
 
-		// Keep running
-		select {}
+		// Block until SIGINT/SIGTERM, then drain in-flight jobs on the way out.
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		<-sigCh
+		logger.Info("shutting down, draining in-flight cleanup jobs")
 
 	case "cleanup":
 		if *clipId == "" {
@@ -304,7 +859,14 @@ func main() {
 		if *clipId == "" {
 			log.Fatal("clip ID required for dedupe action")
 		}
-		if err := agent.DeduplicateClip(*clipId); err != nil {
+		dedupeOpts := &pb.DedupeOptions{
+			EpsilonMs:     *dedupeEpsilonMs,
+			MergeStrategy: *dedupeMergeStrategy,
+			FlamMinMs:     *flamMinMs,
+			FlamMaxMs:     *flamMaxMs,
+			KeepFlams:     *keepFlams,
+		}
+		if err := agent.DeduplicateClip(*clipId, dedupeOpts); err != nil {
 			log.Fatalf("Deduplication failed: %v", err)
 		}
 
@@ -312,13 +874,53 @@ func main() {
 		if *clipId == "" {
 			log.Fatal("clip ID required for quantize action")
 		}
-		if err := agent.QuantizeClip(*clipId, 0.25); err != nil {
+		opts := &pb.QuantizeOptions{
+			Grid:             *grid,
+			Swing:            *swing,
+			Strength:         *strength,
+			RandomizeMs:      *randomizeMs,
+			GrooveTemplateId: *grooveTemplate,
+			PreserveVelocity: *preserveVelocity,
+		}
+		if err := agent.QuantizeClip(*clipId, opts, *grooveReferenceClip); err != nil {
 			log.Fatalf("Quantization failed: %v", err)
 		}
 
+	case "undo":
+		if *clipId == "" {
+			log.Fatal("clip ID required for undo action")
+		}
+		if err := agent.UndoLast(*clipId); err != nil {
+			log.Fatalf("Undo failed: %v", err)
+		}
+
+	case "redo":
+		if *clipId == "" {
+			log.Fatal("clip ID required for redo action")
+		}
+		if err := agent.RedoLast(*clipId); err != nil {
+			log.Fatalf("Redo failed: %v", err)
+		}
+
+	case "import-smf":
+		if *smfFilePath == "" || *trackId == "" {
+			log.Fatal("-file and -track are required for import-smf action")
+		}
+		if _, err := agent.ImportSMF(*smfFilePath, *trackId); err != nil {
+			log.Fatalf("SMF import failed: %v", err)
+		}
+
+	case "export-smf":
+		if *clipId == "" || *smfFilePath == "" {
+			log.Fatal("-clip and -file are required for export-smf action")
+		}
+		if err := agent.ExportSMF(*clipId, *smfFilePath); err != nil {
+			log.Fatalf("SMF export failed: %v", err)
+		}
+
 	default:
 		log.Fatalf("Unknown action: %s", *action)
 	}
 
-	fmt.Printf("✅ Agent task completed\n")
+	logger.Info("agent task completed")
 }
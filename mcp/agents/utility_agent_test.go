@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"magica/mcp/internal/metrics"
+	pb "magica/mcp/proto/magica_daw"
+)
+
+func syntheticClip() []*pb.MidiNote {
+	return []*pb.MidiNote{
+		{Pitch: 60, StartTime: 0.1, Duration: 0.5, Velocity: 100},
+		{Pitch: 62, StartTime: 0.6, Duration: 0.5, Velocity: 100},
+		{Pitch: 64, StartTime: 1.4, Duration: 0.5, Velocity: 100},
+	}
+}
+
+func TestQuantizeNotesStrengthZeroIsNoOp(t *testing.T) {
+	notes := syntheticClip()
+	opts := &pb.QuantizeOptions{Grid: 0.25, Swing: 0.5, Strength: 0}
+
+	result := quantizeNotes(notes, opts, nil)
+
+	for i, note := range result {
+		if note.StartTime != notes[i].StartTime {
+			t.Errorf("note %d: expected StartTime %.3f to be unchanged, got %.3f", i, notes[i].StartTime, note.StartTime)
+		}
+	}
+}
+
+func TestQuantizeNotesStrengthOneMatchesHardSnap(t *testing.T) {
+	notes := syntheticClip()
+	opts := &pb.QuantizeOptions{Grid: 0.25, Strength: 1}
+
+	result := quantizeNotes(notes, opts, nil)
+
+	want := []float64{0.0, 0.5, 1.5}
+	for i, note := range result {
+		if note.StartTime != want[i] {
+			t.Errorf("note %d: expected hard-snapped StartTime %.3f, got %.3f", i, want[i], note.StartTime)
+		}
+	}
+}
+
+func TestQuantizeNotesSwingAppliedToOffBeatOnly(t *testing.T) {
+	notes := []*pb.MidiNote{
+		{Pitch: 60, StartTime: 0.0, Duration: 0.5, Velocity: 100},  // on-beat, step 0
+		{Pitch: 62, StartTime: 0.27, Duration: 0.5, Velocity: 100}, // off-beat, step 1
+	}
+	opts := &pb.QuantizeOptions{Grid: 0.25, Swing: 0.5, Strength: 1}
+
+	result := quantizeNotes(notes, opts, nil)
+
+	if result[0].StartTime != 0.0 {
+		t.Errorf("expected on-beat note unaffected by swing, got %.3f", result[0].StartTime)
+	}
+	wantOffBeat := 0.25 + 0.5*0.25 // grid position + swing*grid
+	if result[1].StartTime != wantOffBeat {
+		t.Errorf("expected off-beat note swung to %.3f, got %.3f", wantOffBeat, result[1].StartTime)
+	}
+}
+
+func TestQuantizeNotesGrooveVelocityClampedToMidiRange(t *testing.T) {
+	notes := []*pb.MidiNote{
+		{Pitch: 60, StartTime: 0.0, Duration: 0.5, Velocity: 20},
+	}
+	opts := &pb.QuantizeOptions{Grid: 0.25, Strength: 1}
+	groove := &GrooveTemplate{Offsets: []GrooveOffset{{Step: 0, VelocityAdj: -60}}}
+
+	result := quantizeNotes(notes, opts, groove)
+
+	if got := result[0].Velocity; got < 1 || got > 127 {
+		t.Errorf("expected groove-adjusted velocity clamped to [1,127], got %d", got)
+	}
+}
+
+func TestExtractGrooveTemplateCapturesTimingAndVelocityFeel(t *testing.T) {
+	// Every note on step 1 (grid position 0.25) consistently lands 10ms
+	// late and 10 velocity units hotter than the clip average of 100.
+	notes := []*pb.MidiNote{
+		{Pitch: 60, StartTime: 0.0, Velocity: 100},      // step 0, on the grid
+		{Pitch: 62, StartTime: 0.26, Velocity: 110},     // step 1, +10ms, +10 velocity
+		{Pitch: 64, StartTime: 1.26, Velocity: 110},     // step 5 (one bar later), same feel
+		{Pitch: 65, StartTime: 2.0, Velocity: 100 - 20}, // step 8, pulls the average down
+	}
+
+	tmpl := extractGrooveTemplate(notes, 0.25, 4)
+
+	if got := tmpl.offsetForStep(0).TimingMs; got != 0 {
+		t.Errorf("expected on-grid step 0 to have zero timing offset, got %.3f", got)
+	}
+
+	wantStep1 := 10.0
+	if got := tmpl.offsetForStep(1).TimingMs; math.Abs(got-wantStep1) > 1e-6 {
+		t.Errorf("expected step 1 timing offset %.3fms (averaged across 2 occurrences), got %.3f", wantStep1, got)
+	}
+
+	if got := tmpl.offsetForStep(1).VelocityAdj; got != 10 {
+		t.Errorf("expected step 1 velocity offset +10 against the clip average of 100, got %d", got)
+	}
+}
+
+func TestCleanupQueueCoalescesRepeatedEventsForSameClip(t *testing.T) {
+	var runs int32
+	var mu sync.Mutex
+	var ranClips []string
+
+	registry := metrics.NewRegistry()
+	queuedGauge := registry.NewGauge("test_cleanup_jobs_queued", "jobs waiting")
+	inFlightGauge := registry.NewGauge("test_cleanup_jobs_in_flight", "jobs running")
+
+	q := newCleanupQueue(20*time.Millisecond, 2, queuedGauge, inFlightGauge, func(job *cleanupJob) {
+		atomic.AddInt32(&runs, 1)
+		mu.Lock()
+		ranClips = append(ranClips, job.ClipId)
+		mu.Unlock()
+	})
+
+	// Repeated events on the same clip within the debounce window should
+	// coalesce into a single cleanup run.
+	q.Enqueue("clip-1")
+	q.Enqueue("clip-1")
+	q.Enqueue("clip-1")
+	q.Enqueue("clip-2")
+
+	q.Drain()
+
+	if got := atomic.LoadInt32(&runs); got != 2 {
+		t.Errorf("expected 2 coalesced cleanup runs, got %d: %v", got, ranClips)
+	}
+}
@@ -0,0 +1,234 @@
+// Package metrics is a minimal, dependency-free Prometheus exposition
+// helper shared by MAGICA agents. It implements just enough of the text
+// exposition format (counters, gauges, histograms) for an agent to expose
+// an HTTP /metrics endpoint without pulling in the full client library.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Counter is a monotonically increasing value, optionally partitioned by
+// a single label (e.g. event_type).
+type Counter struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	label  string
+	values map[string]float64
+}
+
+func newCounter(name, help, label string) *Counter {
+	return &Counter{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+// Inc increments the counter for labelValue by 1. Pass "" if the counter
+// has no label.
+func (c *Counter) Inc(labelValue string) {
+	c.Add(labelValue, 1)
+}
+
+// Add increments the counter for labelValue by delta.
+func (c *Counter) Add(labelValue string, delta float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelValue] += delta
+}
+
+func (c *Counter) writeTo(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, lv := range sortedKeys(c.values) {
+		if c.label == "" {
+			fmt.Fprintf(b, "%s %g\n", c.name, c.values[lv])
+		} else {
+			fmt.Fprintf(b, "%s{%s=%q} %g\n", c.name, c.label, lv, c.values[lv])
+		}
+	}
+}
+
+// Gauge is a value that can go up or down, such as a queue depth.
+type Gauge struct {
+	mu    sync.Mutex
+	name  string
+	help  string
+	value float64
+}
+
+func newGauge(name, help string) *Gauge {
+	return &Gauge{name: name, help: help}
+}
+
+// Set pins the gauge to value.
+func (g *Gauge) Set(value float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value = value
+}
+
+// Add adjusts the gauge by delta (use a negative delta to decrement).
+func (g *Gauge) Add(delta float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value += delta
+}
+
+func (g *Gauge) writeTo(b *strings.Builder) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, g.value)
+}
+
+// Histogram tracks the distribution of a value (e.g. op latency in
+// seconds, or clip size in notes) against a fixed set of upper bounds.
+type Histogram struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	total   uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *Histogram {
+	return &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Observe records a single sample.
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.sum += value
+	h.total++
+	for i, upper := range h.buckets {
+		if value <= upper {
+			h.counts[i]++
+		}
+	}
+}
+
+func (h *Histogram) writeTo(b *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, upper := range h.buckets {
+		fmt.Fprintf(b, "%s_bucket{le=%q} %d\n", h.name, fmt.Sprintf("%g", upper), h.counts[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.total)
+	fmt.Fprintf(b, "%s_sum %g\n", h.name, h.sum)
+	fmt.Fprintf(b, "%s_count %d\n", h.name, h.total)
+}
+
+// Registry collects an agent's metrics and renders them in Prometheus
+// text exposition format.
+type Registry struct {
+	mu         sync.Mutex
+	counters   []*Counter
+	gauges     []*Gauge
+	histograms []*Histogram
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// NewCounter registers and returns a new Counter. Pass a non-empty label
+// name (e.g. "event_type") to partition it, or "" for an unlabeled counter.
+func (r *Registry) NewCounter(name, help, label string) *Counter {
+	c := newCounter(name, help, label)
+	r.mu.Lock()
+	r.counters = append(r.counters, c)
+	r.mu.Unlock()
+	return c
+}
+
+// NewGauge registers and returns a new Gauge.
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := newGauge(name, help)
+	r.mu.Lock()
+	r.gauges = append(r.gauges, g)
+	r.mu.Unlock()
+	return g
+}
+
+// NewHistogram registers and returns a new Histogram with the given
+// upper bucket bounds.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(name, help, buckets)
+	r.mu.Lock()
+	r.histograms = append(r.histograms, h)
+	r.mu.Unlock()
+	return h
+}
+
+// Render produces the full text exposition for all registered metrics.
+func (r *Registry) Render() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+	for _, c := range r.counters {
+		c.writeTo(&b)
+	}
+	for _, g := range r.gauges {
+		g.writeTo(&b)
+	}
+	for _, h := range r.histograms {
+		h.writeTo(&b)
+	}
+	return b.String()
+}
+
+// Server serves a Registry's metrics over HTTP at /metrics.
+type Server struct {
+	registry *Registry
+	http     *http.Server
+}
+
+// NewServer builds (but does not start) a metrics HTTP server listening
+// on addr.
+func NewServer(addr string, registry *Registry) *Server {
+	mux := http.NewServeMux()
+	s := &Server{registry: registry}
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(registry.Render()))
+	})
+	s.http = &http.Server{Addr: addr, Handler: mux}
+	return s
+}
+
+// Start begins serving in the background. Errors other than a clean
+// shutdown are sent to errCh.
+func (s *Server) Start(errCh chan<- error) {
+	go func() {
+		if err := s.http.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+	}()
+}
+
+// Close shuts the metrics server down cleanly.
+func (s *Server) Close(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCounterIncPartitionsByLabel(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("events_total", "events received", "event_type")
+
+	c.Inc("CLIP_CREATED")
+	c.Inc("CLIP_CREATED")
+	c.Inc("TRACK_CREATED")
+
+	out := r.Render()
+	if want := `events_total{event_type="CLIP_CREATED"} 2`; !strings.Contains(out, want) {
+		t.Errorf("expected %q in output, got:\n%s", want, out)
+	}
+	if want := `events_total{event_type="TRACK_CREATED"} 1`; !strings.Contains(out, want) {
+		t.Errorf("expected %q in output, got:\n%s", want, out)
+	}
+}
+
+func TestGaugeSetAndAdd(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGauge("queued_jobs", "jobs waiting")
+
+	g.Set(3)
+	g.Add(-1)
+
+	out := r.Render()
+	if want := "queued_jobs 2"; !strings.Contains(out, want) {
+		t.Errorf("expected %q in output, got:\n%s", want, out)
+	}
+}
+
+func TestHistogramObserveBucketsAndCount(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("op_latency_seconds", "op latency", []float64{0.1, 0.5, 1})
+
+	h.Observe(0.05)
+	h.Observe(0.3)
+	h.Observe(2)
+
+	out := r.Render()
+	if want := `op_latency_seconds_bucket{le="0.1"} 1`; !strings.Contains(out, want) {
+		t.Errorf("expected %q in output, got:\n%s", want, out)
+	}
+	if want := "op_latency_seconds_count 3"; !strings.Contains(out, want) {
+		t.Errorf("expected %q in output, got:\n%s", want, out)
+	}
+}